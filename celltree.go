@@ -4,95 +4,408 @@
 
 package celltree
 
+import (
+	"sync"
+	"sync/atomic"
+)
+
 const maxItems = 256 // max items per node
 const nBits = 8      // 1, 2,  4,   8  - match nNodes with the correct nBits
 const nNodes = 256   // 2, 4, 16, 256  - match nNodes with the correct nBits
 
-type item struct {
+const defaultFreeListSize = 32
+
+// cowIDCounter hands out globally unique copy-on-write owner ids, so that
+// Clone() never has to derive a fresh id from a tree's own counter (which
+// could collide across repeated clones of the same tree).
+var cowIDCounter uint64
+
+// nextCowID returns a process-wide unique copy-on-write owner id.
+func nextCowID() uint64 {
+	return atomic.AddUint64(&cowIDCounter, 1)
+}
+
+type item[T any] struct {
 	cell uint64
-	data interface{}
+	data T
 }
 
-type node struct {
-	branch bool    // is a branch (not a leaf)
-	ncount byte    // tracks non-nil nodes, max is 256
-	items  []item  // leaf items
-	nodes  []*node // child nodes
+type node[T any] struct {
+	branch bool                  // is a branch (not a leaf)
+	ncount byte                  // tracks non-nil nodes, max is 256
+	cow    uint64                // copy-on-write owner id, see TreeG.cowID
+	items  []item[T]             // leaf items
+	nodes  []*node[T]            // child nodes
+	anno   map[string]*annoEntry // cached annotation values, by annotator id
 }
 
-// Tree is a uint64 prefix tree
-type Tree struct {
-	count int   // number of items in tree
-	root  *node // root node
+// annoEntry is a cached annotation value for one annotator on one node.
+type annoEntry struct {
+	valid  bool
+	stable bool
+	value  interface{}
+}
+
+// Annotator computes and merges an aggregate value over the cells and data
+// stored in a subtree, modelled on Pebble's manifest B-tree annotator.
+// Accumulate folds a single leaf item into *dst, returning false if the
+// result is not stable (e.g. because it depends on state that may change
+// externally), which causes the cached value to be recomputed on the next
+// read. Merge combines the aggregate values of two sibling subtrees.
+type Annotator interface {
+	Zero() interface{}
+	Accumulate(cell uint64, data interface{}, dst *interface{}) (stable bool)
+	Merge(a, b interface{}) interface{}
+}
+
+// FreeList is a pool of retired *node[T] values, used to amortize
+// allocation for trees that see heavy insert/delete churn (typical of
+// spatial indexes tracking moving objects). A single FreeList may be
+// shared across many trees, which bounds the total memory retained by
+// the pool rather than letting each tree keep its own.
+type FreeList[T any] struct {
+	mu    sync.Mutex
+	nodes []*node[T]
+}
+
+// NewFreeList returns a FreeList that retains up to size nodes. A size of
+// 0 or less uses a reasonable default.
+func NewFreeList[T any](size int) *FreeList[T] {
+	if size <= 0 {
+		size = defaultFreeListSize
+	}
+	return &FreeList[T]{nodes: make([]*node[T], 0, size)}
+}
+
+func (f *FreeList[T]) newNode() *node[T] {
+	f.mu.Lock()
+	index := len(f.nodes) - 1
+	if index < 0 {
+		f.mu.Unlock()
+		return new(node[T])
+	}
+	n := f.nodes[index]
+	f.nodes[index] = nil
+	f.nodes = f.nodes[:index]
+	f.mu.Unlock()
+	return n
+}
+
+// freeNode retires n, along with its items/nodes backing arrays, so a
+// later newNode can reuse them. It's a no-op once the list is at capacity.
+func (f *FreeList[T]) freeNode(n *node[T]) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.nodes) < cap(f.nodes) {
+		*n = node[T]{items: n.items[:0], nodes: n.nodes[:0]}
+		f.nodes = append(f.nodes, n)
+	}
+}
+
+// TreeG is a uint64 prefix tree that stores items of a concrete type T.
+// It's the generic counterpart to Tree, and avoids the interface{} boxing
+// and dispatch that Tree incurs for every item.
+type TreeG[T any] struct {
+	count      int                  // number of items in tree
+	root       *node[T]             // root node
+	cowID      uint64               // current copy-on-write owner id, see Clone
+	annotators map[string]Annotator // registered annotators, by id
+	freelist   *FreeList[T]         // optional node pool, see NewTreeG
+}
+
+// NewTreeG returns a TreeG that draws its nodes from fl, amortizing
+// allocation under insert/delete churn. fl may be shared with other trees
+// of the same element type to bound total retained memory.
+func NewTreeG[T any](fl *FreeList[T]) *TreeG[T] {
+	return &TreeG[T]{freelist: fl}
+}
+
+// newNode allocates a node, drawing from tr.freelist when one is set.
+func (tr *TreeG[T]) newNode() *node[T] {
+	var n *node[T]
+	if tr.freelist != nil {
+		n = tr.freelist.newNode()
+	} else {
+		n = new(node[T])
+	}
+	n.cow = tr.cowID
+	return n
 }
 
 // Insert inserts an item into the tree. Items are ordered by it's cell.
 // The extra param is a simple user context value.
-func (tr *Tree) Insert(cell uint64, data interface{}) {
+func (tr *TreeG[T]) Insert(cell uint64, data T) {
 	if tr.root == nil {
-		tr.root = new(node)
+		tr.root = tr.newNode()
 	}
-	tr.insert(tr.root, cell, data, 64-nBits)
+	tr.root = tr.insert(tr.root, cell, data, 64-nBits)
 	tr.count++
 }
 
 // Count returns the number of items in the tree.
-func (tr *Tree) Count() int {
+func (tr *TreeG[T]) Count() int {
 	return tr.count
 }
 
+// Clone returns a new tree that's an independent copy of tr. The operation
+// is O(1); the two trees share structure until one of them is mutated, at
+// which point the touched nodes are copied on write.
+func (tr *TreeG[T]) Clone() *TreeG[T] {
+	tr.cowID = nextCowID()
+	var annotators map[string]Annotator
+	if tr.annotators != nil {
+		annotators = make(map[string]Annotator, len(tr.annotators))
+		for id, a := range tr.annotators {
+			annotators[id] = a
+		}
+	}
+	return &TreeG[T]{
+		count:      tr.count,
+		root:       tr.root,
+		cowID:      nextCowID(),
+		annotators: annotators,
+		freelist:   tr.freelist,
+	}
+}
+
+// cowLoad returns a node that's safe for tr to mutate, cloning n first if
+// it's still owned by a different (cloned) tree. Either way, the node's
+// cached annotations are dropped, since cowLoad is only ever called right
+// before the node (or one of its fields) is mutated.
+func (tr *TreeG[T]) cowLoad(n *node[T]) *node[T] {
+	if n.cow == tr.cowID {
+		n.anno = nil
+		return n
+	}
+	n2 := tr.newNode()
+	n2.branch = n.branch
+	n2.ncount = n.ncount
+	if n.branch {
+		n2.nodes = append(n2.nodes[:0], n.nodes...)
+	} else {
+		n2.items = append(n2.items[:0], n.items...)
+	}
+	return n2
+}
+
+// RegisterAnnotator associates an Annotator with id, so that Annotation can
+// later query aggregate values over any prefix of the tree. Registering
+// under an id that's already in use replaces the previous annotator, and
+// drops every cached value computed by the one it replaces.
+func (tr *TreeG[T]) RegisterAnnotator(id string, a Annotator) {
+	if tr.annotators == nil {
+		tr.annotators = make(map[string]Annotator)
+	}
+	tr.annotators[id] = a
+	if tr.root != nil {
+		invalidateAnno(tr.root, id)
+	}
+}
+
+// invalidateAnno drops the cached annotation value for id from n and every
+// node in its subtree.
+func invalidateAnno[T any](n *node[T], id string) {
+	if n.anno != nil {
+		delete(n.anno, id)
+	}
+	if n.branch {
+		for _, c := range n.nodes {
+			if c != nil {
+				invalidateAnno(c, id)
+			}
+		}
+	}
+}
+
+// Annotation returns the aggregate value, as computed by the Annotator
+// registered under id, over every cell sharing the top prefixBits bits of
+// prefixCell. It walks down to the nodes covering the prefix and returns
+// cached values where available, recomputing (and caching) bottom-up only
+// the invalid parts of the covered subtrees. When prefixBits doesn't fall
+// on a node boundary, the result is merged across every sibling subtree
+// that matches the prefix, rather than the single subtree that happens to
+// contain prefixCell.
+func (tr *TreeG[T]) Annotation(id string, prefixCell uint64, prefixBits uint) interface{} {
+	a, ok := tr.annotators[id]
+	if !ok {
+		return nil
+	}
+	if tr.root == nil {
+		return a.Zero()
+	}
+	val, _ := tr.annoQuery(tr.root, prefixCell, prefixBits, 64-nBits, id, a)
+	return val
+}
+
+// annoQuery returns the aggregate value over every cell in the subtree
+// rooted at n that shares the top prefixBits bits of prefixCell. bits is
+// the shift used to index into n, as in insert/remove. consumed (derived
+// from bits) tracks how many of prefixCell's top bits are already
+// guaranteed to match by virtue of having reached n; once consumed covers
+// all of prefixBits, the whole subtree matches and the cached per-node
+// annotation can be used directly.
+func (tr *TreeG[T]) annoQuery(n *node[T], prefixCell uint64, prefixBits, bits uint, id string, a Annotator) (interface{}, bool) {
+	consumed := 64 - nBits - bits
+	if consumed >= prefixBits {
+		return tr.annotation(n, id, a)
+	}
+	if !n.branch {
+		return tr.annoLeafFiltered(n, prefixCell, prefixBits, a)
+	}
+	rem := prefixBits - consumed
+	index := cellIndex(prefixCell, bits)
+	if rem >= nBits {
+		if index >= len(n.nodes) || n.nodes[index] == nil {
+			return a.Zero(), true
+		}
+		return tr.annoQuery(n.nodes[index], prefixCell, prefixBits, bits-nBits, id, a)
+	}
+	// The prefix boundary falls inside this level's index, so no single
+	// child covers exactly prefixCell's prefix: merge every child whose
+	// index shares the top rem bits with index.
+	shift := nBits - rem
+	target := index >> shift
+	var val interface{}
+	first := true
+	stable := true
+	for i, child := range n.nodes {
+		if child == nil || i>>shift != target {
+			continue
+		}
+		cval, cstable := tr.annotation(child, id, a)
+		stable = stable && cstable
+		if first {
+			val, first = cval, false
+		} else {
+			val = a.Merge(val, cval)
+		}
+	}
+	if first {
+		val = a.Zero()
+	}
+	return val, stable
+}
+
+// annoLeafFiltered accumulates only the items in leaf n whose cell shares
+// the top prefixBits bits of prefixCell. It's used when the requested
+// prefix terminates partway through a leaf, so the leaf's items can't be
+// accumulated (or cached) as a whole.
+func (tr *TreeG[T]) annoLeafFiltered(n *node[T], prefixCell uint64, prefixBits uint, a Annotator) (interface{}, bool) {
+	shift := 64 - prefixBits
+	target := prefixCell >> shift
+	val := a.Zero()
+	stable := true
+	for i := range n.items {
+		if n.items[i].cell>>shift != target {
+			continue
+		}
+		s := a.Accumulate(n.items[i].cell, n.items[i].data, &val)
+		stable = stable && s
+	}
+	return val, stable
+}
+
+// annotation returns the (possibly cached) aggregate value for the entire
+// subtree rooted at n, recomputing and caching it if necessary.
+func (tr *TreeG[T]) annotation(n *node[T], id string, a Annotator) (interface{}, bool) {
+	if e, ok := n.anno[id]; ok && e.valid {
+		return e.value, e.stable
+	}
+	var val interface{}
+	stable := true
+	if !n.branch {
+		val = a.Zero()
+		for i := range n.items {
+			s := a.Accumulate(n.items[i].cell, n.items[i].data, &val)
+			stable = stable && s
+		}
+	} else {
+		first := true
+		for i := range n.nodes {
+			if n.nodes[i] == nil {
+				continue
+			}
+			cval, cstable := tr.annotation(n.nodes[i], id, a)
+			stable = stable && cstable
+			if first {
+				val, first = cval, false
+			} else {
+				val = a.Merge(val, cval)
+			}
+		}
+		if first {
+			val = a.Zero()
+		}
+	}
+	// an unstable result must never be cached: serving it even once would
+	// let a later read observe data that's already changed out from under
+	// the tree, which is exactly what stable=false exists to prevent.
+	if stable {
+		if n.anno == nil {
+			n.anno = make(map[string]*annoEntry)
+		}
+		n.anno[id] = &annoEntry{valid: true, stable: stable, value: val}
+	} else if n.anno != nil {
+		delete(n.anno, id)
+	}
+	return val, stable
+}
+
 func cellIndex(cell uint64, bits uint) int {
 	return int(cell >> bits & uint64(nNodes-1))
 }
 
-func (tr *Tree) insert(n *node, cell uint64, data interface{}, bits uint) {
+func (tr *TreeG[T]) insert(n *node[T], cell uint64, data T, bits uint) *node[T] {
 	if !n.branch {
 		// leaf node
 		if bits != 0 && len(n.items) >= maxItems {
 			// split leaf. it's at capacity
+			n = tr.cowLoad(n)
 			tr.split(n, bits)
 			// insert item again
-			tr.insert(n, cell, data, bits)
-		} else {
-			// find the target index for the new cell
-			if len(n.items) == 0 || n.items[len(n.items)-1].cell <= cell {
-				// the new cell is greater than the last cell in leaf, so
-				// we can just append it
-				n.items = append(n.items, item{cell: cell, data: data})
-			} else {
-				index := tr.find(n, cell)
-				// create space for the new cell
-				n.items = append(n.items, item{})
-				// move other cells over to make room for new cell
-				copy(n.items[index+1:], n.items[index:len(n.items)-1])
-				// assign the new cell
-				n.items[index] = item{cell: cell, data: data}
-			}
-		}
-	} else {
-		// branch node
-		index := cellIndex(cell, bits)
-		for index >= len(n.nodes) {
-			n.nodes = append(n.nodes, nil)
+			return tr.insert(n, cell, data, bits)
 		}
-		if n.nodes[index] == nil {
-			n.nodes[index] = new(node)
-			n.ncount++
+		n = tr.cowLoad(n)
+		// find the target index for the new cell
+		if len(n.items) == 0 || n.items[len(n.items)-1].cell <= cell {
+			// the new cell is greater than the last cell in leaf, so
+			// we can just append it
+			n.items = append(n.items, item[T]{cell: cell, data: data})
+		} else {
+			index := tr.find(n, cell)
+			// create space for the new cell
+			n.items = append(n.items, item[T]{})
+			// move other cells over to make room for new cell
+			copy(n.items[index+1:], n.items[index:len(n.items)-1])
+			// assign the new cell
+			n.items[index] = item[T]{cell: cell, data: data}
 		}
-		tr.insert(n.nodes[index], cell, data, bits-nBits)
+		return n
+	}
+	// branch node
+	n = tr.cowLoad(n)
+	index := cellIndex(cell, bits)
+	for index >= len(n.nodes) {
+		n.nodes = append(n.nodes, nil)
 	}
+	if n.nodes[index] == nil {
+		n.nodes[index] = tr.newNode()
+		n.ncount++
+	}
+	n.nodes[index] = tr.insert(n.nodes[index], cell, data, bits-nBits)
+	return n
 }
 
-func (tr *Tree) split(n *node, bits uint) {
+func (tr *TreeG[T]) split(n *node[T], bits uint) {
 	n.branch = true
 	for i := 0; i < len(n.items); i++ {
-		tr.insert(n, n.items[i].cell, n.items[i].data, bits)
+		n = tr.insert(n, n.items[i].cell, n.items[i].data, bits)
 	}
 	n.items = nil
 }
 
 // find an index of the cell using a binary search
-func (tr *Tree) find(n *node, cell uint64) int {
+func (tr *TreeG[T]) find(n *node[T], cell uint64) int {
 	i, j := 0, len(n.items)
 	for i < j {
 		h := i + (j-i)/2
@@ -105,43 +418,55 @@ func (tr *Tree) find(n *node, cell uint64) int {
 	return i
 }
 
-// Remove removes an item from the tree based on it's cell and data values.
-func (tr *Tree) Remove(cell uint64, data interface{}) {
+// Remove removes an item from the tree based on it's cell, deleting at
+// most one item at that cell for which eq returns true: the last such item
+// in tree order.
+func (tr *TreeG[T]) Remove(cell uint64, eq func(data T) bool) {
 	if tr.root == nil {
 		return
 	}
-	if tr.remove(tr.root, cell, data, 64-nBits, nil) {
+	root, removed := tr.remove(tr.root, cell, 64-nBits, eq)
+	tr.root = root
+	if removed {
 		tr.count--
 	}
 }
 
-func (tr *Tree) remove(n *node, cell uint64, data interface{}, bits uint,
-	cond func(data interface{}) bool,
-) bool {
+func (tr *TreeG[T]) remove(n *node[T], cell uint64, bits uint,
+	eq func(data T) bool,
+) (*node[T], bool) {
 	if !n.branch {
 		i := tr.find(n, cell) - 1
 		for ; i >= 0; i-- {
 			if n.items[i].cell != cell {
 				break
 			}
-			if (cond == nil && n.items[i].data == data) ||
-				(cond != nil && cond(n.items[i].data)) {
-				n.items[i] = item{}
+			if eq(n.items[i].data) {
+				n = tr.cowLoad(n)
+				n.items[i] = item[T]{}
 				copy(n.items[i:len(n.items)-1], n.items[i+1:])
 				n.items = n.items[:len(n.items)-1]
-				return true
+				return n, true
 			}
 		}
-		return false
+		return n, false
 	}
 	index := cellIndex(cell, bits)
-	if index >= len(n.nodes) || n.nodes[index] == nil ||
-		!tr.remove(n.nodes[index], cell, data, bits-nBits, cond) {
+	if index >= len(n.nodes) || n.nodes[index] == nil {
 		// didn't find the cell
-		return false
+		return n, false
+	}
+	child, removed := tr.remove(n.nodes[index], cell, bits-nBits, eq)
+	if !removed {
+		return n, false
 	}
+	n = tr.cowLoad(n)
+	n.nodes[index] = child
 	if !n.nodes[index].branch && len(n.nodes[index].items) == 0 {
 		// target leaf is empty, remove it.
+		if tr.freelist != nil {
+			tr.freelist.freeNode(n.nodes[index])
+		}
 		n.nodes[index] = nil
 		n.ncount--
 		if n.ncount == 0 {
@@ -150,29 +475,214 @@ func (tr *Tree) remove(n *node, cell uint64, data interface{}, bits uint,
 			n.items = nil
 		}
 	}
-	return true
+	return n, true
 }
 
-// RemoveWhen removes an item from the tree based on it's cell and
-// when the cond func returns true. It will delete at most a maximum of one item.
-func (tr *Tree) RemoveWhen(cell uint64, cond func(data interface{}) bool) {
+// PathHint is a hint used to speed up Insert, Remove, and Range when
+// operations are performed in batches of clustered cells, i.e. cells that
+// share many of their high-order bits. It caches the position of the last
+// touched leaf item, and is updated in place as each hinted operation
+// touches a leaf. The zero value is ready to use.
+type PathHint struct {
+	leafPos int
+}
+
+// findHint is like find, but first probes hint.leafPos -- the insertion
+// point found by the previous hinted operation -- and only falls back to
+// the binary search when that guess no longer holds.
+func (tr *TreeG[T]) findHint(n *node[T], cell uint64, hint *PathHint) int {
+	if hint != nil {
+		i := hint.leafPos
+		if i >= 0 && i <= len(n.items) &&
+			(i == 0 || n.items[i-1].cell <= cell) &&
+			(i == len(n.items) || cell < n.items[i].cell) {
+			return i
+		}
+	}
+	return tr.find(n, cell)
+}
+
+// InsertHint is like Insert, but accepts a *PathHint that's reused across
+// calls to speed up clustered-key workloads, where consecutive cells share
+// many of their high-order bits and thus reuse the same root-to-leaf path.
+func (tr *TreeG[T]) InsertHint(cell uint64, data T, hint *PathHint) {
+	if tr.root == nil {
+		tr.root = tr.newNode()
+	}
+	tr.root = tr.insertHint(tr.root, cell, data, 64-nBits, hint)
+	tr.count++
+}
+
+func (tr *TreeG[T]) insertHint(n *node[T], cell uint64, data T, bits uint, hint *PathHint) *node[T] {
+	if !n.branch {
+		// leaf node
+		if bits != 0 && len(n.items) >= maxItems {
+			// split leaf. it's at capacity
+			n = tr.cowLoad(n)
+			tr.split(n, bits)
+			// insert item again
+			return tr.insertHint(n, cell, data, bits, hint)
+		}
+		n = tr.cowLoad(n)
+		// find the target index for the new cell
+		if len(n.items) == 0 || n.items[len(n.items)-1].cell <= cell {
+			// the new cell is greater than the last cell in leaf, so
+			// we can just append it
+			if hint != nil {
+				hint.leafPos = len(n.items)
+			}
+			n.items = append(n.items, item[T]{cell: cell, data: data})
+		} else {
+			index := tr.findHint(n, cell, hint)
+			// create space for the new cell
+			n.items = append(n.items, item[T]{})
+			// move other cells over to make room for new cell
+			copy(n.items[index+1:], n.items[index:len(n.items)-1])
+			// assign the new cell
+			n.items[index] = item[T]{cell: cell, data: data}
+			if hint != nil {
+				hint.leafPos = index
+			}
+		}
+		return n
+	}
+	// branch node
+	n = tr.cowLoad(n)
+	index := cellIndex(cell, bits)
+	for index >= len(n.nodes) {
+		n.nodes = append(n.nodes, nil)
+	}
+	if n.nodes[index] == nil {
+		n.nodes[index] = tr.newNode()
+		n.ncount++
+	}
+	n.nodes[index] = tr.insertHint(n.nodes[index], cell, data, bits-nBits, hint)
+	return n
+}
+
+// RemoveHint is like Remove, but accepts a *PathHint that's reused across
+// calls to speed up clustered-key workloads.
+func (tr *TreeG[T]) RemoveHint(cell uint64, eq func(data T) bool, hint *PathHint) {
 	if tr.root == nil {
 		return
 	}
-	if tr.remove(tr.root, cell, nil, 64-nBits, cond) {
+	root, removed := tr.removeHint(tr.root, cell, 64-nBits, eq, hint)
+	tr.root = root
+	if removed {
 		tr.count--
 	}
 }
 
+func (tr *TreeG[T]) removeHint(n *node[T], cell uint64, bits uint,
+	eq func(data T) bool, hint *PathHint,
+) (*node[T], bool) {
+	if !n.branch {
+		i := tr.findHint(n, cell, hint) - 1
+		for ; i >= 0; i-- {
+			if n.items[i].cell != cell {
+				break
+			}
+			if eq(n.items[i].data) {
+				n = tr.cowLoad(n)
+				n.items[i] = item[T]{}
+				copy(n.items[i:len(n.items)-1], n.items[i+1:])
+				n.items = n.items[:len(n.items)-1]
+				if hint != nil {
+					hint.leafPos = i
+				}
+				return n, true
+			}
+		}
+		return n, false
+	}
+	index := cellIndex(cell, bits)
+	if index >= len(n.nodes) || n.nodes[index] == nil {
+		// didn't find the cell
+		return n, false
+	}
+	child, removed := tr.removeHint(n.nodes[index], cell, bits-nBits, eq, hint)
+	if !removed {
+		return n, false
+	}
+	n = tr.cowLoad(n)
+	n.nodes[index] = child
+	if !n.nodes[index].branch && len(n.nodes[index].items) == 0 {
+		// target leaf is empty, remove it.
+		if tr.freelist != nil {
+			tr.freelist.freeNode(n.nodes[index])
+		}
+		n.nodes[index] = nil
+		n.ncount--
+		if n.ncount == 0 {
+			// node is empty, convert it to a leaf
+			n.branch = false
+			n.items = nil
+		}
+	}
+	return n, true
+}
+
+// RangeHint is like Range, but accepts a *PathHint that's reused across
+// calls to speed up clustered-key workloads.
+func (tr *TreeG[T]) RangeHint(cell uint64, iter func(cell uint64, data T) bool, hint *PathHint) {
+	if tr.root == nil {
+		return
+	}
+	tr._rangeHint(tr.root, cell, 64-nBits, iter, hint)
+}
+
+func (tr *TreeG[T]) _rangeHint(n *node[T], cell uint64, bits uint,
+	iter func(cell uint64, data T) bool, hint *PathHint,
+) (hit, ok bool) {
+	if !n.branch {
+		hit = true
+		i := tr.findHint(n, cell, hint) - 1
+		for ; i >= 0; i-- {
+			if n.items[i].cell < cell {
+				break
+			}
+		}
+		i++
+		if hint != nil {
+			hint.leafPos = i
+		}
+		for ; i < len(n.items); i++ {
+			if !iter(n.items[i].cell, n.items[i].data) {
+				return hit, false
+			}
+		}
+		return hit, true
+	}
+	index := cellIndex(cell, bits)
+	if index >= len(n.nodes) || n.nodes[index] == nil {
+		return hit, true
+	}
+	for ; index < len(n.nodes); index++ {
+		if n.nodes[index] != nil {
+			if hit {
+				if !tr.scan(n.nodes[index], iter) {
+					return hit, false
+				}
+			} else {
+				hit, ok = tr._rangeHint(n.nodes[index], cell, bits-nBits, iter, hint)
+				if !ok {
+					return hit, false
+				}
+			}
+		}
+	}
+	return hit, true
+}
+
 // Scan iterates over the entire tree. Return false from the iter function to stop.
-func (tr *Tree) Scan(iter func(cell uint64, data interface{}) bool) {
+func (tr *TreeG[T]) Scan(iter func(cell uint64, data T) bool) {
 	if tr.root == nil {
 		return
 	}
 	tr.scan(tr.root, iter)
 }
 
-func (tr *Tree) scan(n *node, iter func(cell uint64, data interface{}) bool) bool {
+func (tr *TreeG[T]) scan(n *node[T], iter func(cell uint64, data T) bool) bool {
 	if !n.branch {
 		for i := 0; i < len(n.items); i++ {
 			if !iter(n.items[i].cell, n.items[i].data) {
@@ -192,14 +702,14 @@ func (tr *Tree) scan(n *node, iter func(cell uint64, data interface{}) bool) boo
 }
 
 // Range iterates over the three start with the cell param.
-func (tr *Tree) Range(cell uint64, iter func(cell uint64, key interface{}) bool) {
+func (tr *TreeG[T]) Range(cell uint64, iter func(cell uint64, data T) bool) {
 	if tr.root == nil {
 		return
 	}
 	tr._range(tr.root, cell, 64-nBits, iter)
 }
 
-func (tr *Tree) _range(n *node, cell uint64, bits uint, iter func(cell uint64, data interface{}) bool) (hit, ok bool) {
+func (tr *TreeG[T]) _range(n *node[T], cell uint64, bits uint, iter func(cell uint64, data T) bool) (hit, ok bool) {
 	if !n.branch {
 		hit = true
 		i := tr.find(n, cell) - 1
@@ -236,3 +746,205 @@ func (tr *Tree) _range(n *node, cell uint64, bits uint, iter func(cell uint64, d
 	}
 	return hit, true
 }
+
+// RangeBounded iterates over the tree starting with lo and
+// stops once a cell >= hi is observed (exclusive of hi).
+func (tr *TreeG[T]) RangeBounded(lo, hi uint64, iter func(cell uint64, data T) bool) {
+	if tr.root == nil {
+		return
+	}
+	tr._range(tr.root, lo, 64-nBits, func(cell uint64, data T) bool {
+		if cell >= hi {
+			return false
+		}
+		return iter(cell, data)
+	})
+}
+
+// Descend iterates over the tree in decreasing cell order, starting with
+// the cell param.
+func (tr *TreeG[T]) Descend(cell uint64, iter func(cell uint64, data T) bool) {
+	if tr.root == nil {
+		return
+	}
+	tr._descend(tr.root, cell, 64-nBits, iter)
+}
+
+// DescendRange iterates over the tree in decreasing cell order, starting
+// with hi, and stops once a cell < lo is observed (inclusive of lo).
+func (tr *TreeG[T]) DescendRange(hi, lo uint64, iter func(cell uint64, data T) bool) {
+	if tr.root == nil {
+		return
+	}
+	tr._descend(tr.root, hi, 64-nBits, func(cell uint64, data T) bool {
+		if cell < lo {
+			return false
+		}
+		return iter(cell, data)
+	})
+}
+
+func (tr *TreeG[T]) scanDesc(n *node[T], iter func(cell uint64, data T) bool) bool {
+	if !n.branch {
+		for i := len(n.items) - 1; i >= 0; i-- {
+			if !iter(n.items[i].cell, n.items[i].data) {
+				return false
+			}
+		}
+	} else {
+		for i := len(n.nodes) - 1; i >= 0; i-- {
+			if n.nodes[i] != nil {
+				if !tr.scanDesc(n.nodes[i], iter) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func (tr *TreeG[T]) _descend(n *node[T], cell uint64, bits uint, iter func(cell uint64, data T) bool) (hit, ok bool) {
+	if !n.branch {
+		hit = true
+		i := tr.find(n, cell) - 1
+		for ; i >= 0; i-- {
+			if !iter(n.items[i].cell, n.items[i].data) {
+				return hit, false
+			}
+		}
+		return hit, true
+	}
+	index := cellIndex(cell, bits)
+	if index >= len(n.nodes) {
+		// cell's own bucket hasn't been created at this depth, so every
+		// existing bucket here sorts below cell and fully qualifies.
+		index = len(n.nodes) - 1
+		hit = true
+	} else if n.nodes[index] == nil {
+		// cell's own bucket is empty at this depth, so every bucket below
+		// it sorts below cell and fully qualifies.
+		hit = true
+	}
+	if index < 0 {
+		return hit, true
+	}
+	for ; index >= 0; index-- {
+		if n.nodes[index] != nil {
+			if hit {
+				if !tr.scanDesc(n.nodes[index], iter) {
+					return hit, false
+				}
+			} else {
+				hit, ok = tr._descend(n.nodes[index], cell, bits-nBits, iter)
+				if !ok {
+					return hit, false
+				}
+			}
+		}
+	}
+	return hit, true
+}
+
+// Tree is a uint64 prefix tree. It's a thin wrapper over TreeG[interface{}],
+// kept for callers that want to store mixed or boxed values without
+// instantiating the generic type themselves.
+type Tree struct {
+	base TreeG[interface{}]
+}
+
+// NewWithFreeList returns a Tree that draws its nodes from fl, amortizing
+// allocation under insert/delete churn. fl may be shared with other trees
+// to bound total retained memory.
+func NewWithFreeList(fl *FreeList[interface{}]) *Tree {
+	return &Tree{base: TreeG[interface{}]{freelist: fl}}
+}
+
+// Insert inserts an item into the tree. Items are ordered by it's cell.
+// The extra param is a simple user context value.
+func (tr *Tree) Insert(cell uint64, data interface{}) {
+	tr.base.Insert(cell, data)
+}
+
+// Count returns the number of items in the tree.
+func (tr *Tree) Count() int {
+	return tr.base.Count()
+}
+
+// Clone returns a new tree that's an independent copy of tr. The operation
+// is O(1); the two trees share structure until one of them is mutated, at
+// which point the touched nodes are copied on write.
+func (tr *Tree) Clone() *Tree {
+	return &Tree{base: *tr.base.Clone()}
+}
+
+// RegisterAnnotator associates an Annotator with id, so that Annotation can
+// later query aggregate values over any prefix of the tree. Registering
+// under an id that's already in use replaces the previous annotator, and
+// drops every cached value computed by the one it replaces.
+func (tr *Tree) RegisterAnnotator(id string, a Annotator) {
+	tr.base.RegisterAnnotator(id, a)
+}
+
+// Annotation returns the aggregate value, as computed by the Annotator
+// registered under id, over every cell sharing the top prefixBits bits of
+// prefixCell.
+func (tr *Tree) Annotation(id string, prefixCell uint64, prefixBits uint) interface{} {
+	return tr.base.Annotation(id, prefixCell, prefixBits)
+}
+
+// InsertHint is like Insert, but accepts a *PathHint that's reused across
+// calls to speed up clustered-key workloads.
+func (tr *Tree) InsertHint(cell uint64, data interface{}, hint *PathHint) {
+	tr.base.InsertHint(cell, data, hint)
+}
+
+// Remove removes an item from the tree based on it's cell and data values.
+func (tr *Tree) Remove(cell uint64, data interface{}) {
+	tr.base.Remove(cell, func(d interface{}) bool { return d == data })
+}
+
+// RemoveHint is like Remove, but accepts a *PathHint that's reused across
+// calls to speed up clustered-key workloads.
+func (tr *Tree) RemoveHint(cell uint64, data interface{}, hint *PathHint) {
+	tr.base.RemoveHint(cell, func(d interface{}) bool { return d == data }, hint)
+}
+
+// RemoveWhen removes an item from the tree based on it's cell and
+// when the cond func returns true. It will delete at most a maximum of one item.
+func (tr *Tree) RemoveWhen(cell uint64, cond func(data interface{}) bool) {
+	tr.base.Remove(cell, cond)
+}
+
+// Scan iterates over the entire tree. Return false from the iter function to stop.
+func (tr *Tree) Scan(iter func(cell uint64, data interface{}) bool) {
+	tr.base.Scan(iter)
+}
+
+// Range iterates over the three start with the cell param.
+func (tr *Tree) Range(cell uint64, iter func(cell uint64, key interface{}) bool) {
+	tr.base.Range(cell, iter)
+}
+
+// RangeHint is like Range, but accepts a *PathHint that's reused across
+// calls to speed up clustered-key workloads.
+func (tr *Tree) RangeHint(cell uint64, iter func(cell uint64, key interface{}) bool, hint *PathHint) {
+	tr.base.RangeHint(cell, iter, hint)
+}
+
+// RangeBounded iterates over the tree starting with lo and
+// stops once a cell >= hi is observed (exclusive of hi).
+func (tr *Tree) RangeBounded(lo, hi uint64, iter func(cell uint64, data interface{}) bool) {
+	tr.base.RangeBounded(lo, hi, iter)
+}
+
+// Descend iterates over the tree in decreasing cell order, starting with
+// the cell param.
+func (tr *Tree) Descend(cell uint64, iter func(cell uint64, data interface{}) bool) {
+	tr.base.Descend(cell, iter)
+}
+
+// DescendRange iterates over the tree in decreasing cell order, starting
+// with hi, and stops once a cell < lo is observed (inclusive of lo).
+func (tr *Tree) DescendRange(hi, lo uint64, iter func(cell uint64, data interface{}) bool) {
+	tr.base.DescendRange(hi, lo, iter)
+}
@@ -0,0 +1,461 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package celltree
+
+import "testing"
+
+// TestClone verifies that Clone() gives back a tree that's independent of
+// its source: mutating one must never be observed through the other, even
+// though they start out sharing structure via copy-on-write.
+func TestClone(t *testing.T) {
+	tr := NewTreeG[string](nil)
+	for i := uint64(0); i < 1000; i++ {
+		tr.Insert(i, "a")
+	}
+	c := tr.Clone()
+	if c.Count() != tr.Count() {
+		t.Fatalf("expected clone to start with count %d, got %d", tr.Count(), c.Count())
+	}
+
+	// mutating the clone must not affect the source.
+	for i := uint64(0); i < 500; i++ {
+		c.Remove(i, func(data string) bool { return true })
+	}
+	if tr.Count() != 1000 {
+		t.Fatalf("expected source count to stay 1000, got %d", tr.Count())
+	}
+	if c.Count() != 500 {
+		t.Fatalf("expected clone count to be 500, got %d", c.Count())
+	}
+
+	// mutating the source must not affect the clone.
+	for i := uint64(1000); i < 1500; i++ {
+		tr.Insert(i, "b")
+	}
+	if tr.Count() != 1500 {
+		t.Fatalf("expected source count to be 1500, got %d", tr.Count())
+	}
+	if c.Count() != 500 {
+		t.Fatalf("expected clone count to stay 500, got %d", c.Count())
+	}
+}
+
+// TestCloneCowIDUnique guards against a prior bug where repeated Clone()
+// calls on the same tree, with no intervening mutation, could hand out the
+// same cowID to two different trees.
+func TestCloneCowIDUnique(t *testing.T) {
+	tr := NewTreeG[string](nil)
+	tr.Insert(1, "a")
+	c1 := tr.Clone()
+	c2 := tr.Clone()
+	if tr.cowID == c1.cowID || tr.cowID == c2.cowID || c1.cowID == c2.cowID {
+		t.Fatalf("expected all cowIDs to be unique, got tr=%d c1=%d c2=%d",
+			tr.cowID, c1.cowID, c2.cowID)
+	}
+}
+
+// TestCloneAnnotatorsIndependent guards against a prior bug where Clone()
+// shared the annotators map with its source, so RegisterAnnotator on one
+// tree was visible (and a concurrent write hazard) on the other.
+func TestCloneAnnotatorsIndependent(t *testing.T) {
+	tr := NewTreeG[string](nil)
+	tr.Insert(1, "a")
+	tr.RegisterAnnotator("count", countAnnotator{})
+	c := tr.Clone()
+	c.RegisterAnnotator("extra", countAnnotator{})
+	if _, ok := tr.annotators["extra"]; ok {
+		t.Fatalf("expected clone-only annotator to not appear on source tree")
+	}
+	if _, ok := c.annotators["count"]; !ok {
+		t.Fatalf("expected clone to inherit annotators registered before Clone()")
+	}
+}
+
+// countAnnotator is an Annotator that counts the number of items in a
+// subtree, used to exercise Annotation in tests.
+type countAnnotator struct{}
+
+func (countAnnotator) Zero() interface{} { return 0 }
+
+func (countAnnotator) Accumulate(cell uint64, data interface{}, dst *interface{}) bool {
+	*dst = (*dst).(int) + 1
+	return true
+}
+
+func (countAnnotator) Merge(a, b interface{}) interface{} {
+	return a.(int) + b.(int)
+}
+
+// TestAnnotationFullTree checks the trivial prefixBits == 0 case, which
+// should aggregate over the whole tree.
+func TestAnnotationFullTree(t *testing.T) {
+	tr := NewTreeG[string](nil)
+	tr.RegisterAnnotator("count", countAnnotator{})
+	for i := uint64(0); i < 300; i++ {
+		tr.Insert(i, "a")
+	}
+	if got := tr.Annotation("count", 0, 0); got.(int) != 300 {
+		t.Fatalf("expected 300, got %v", got)
+	}
+}
+
+// TestAnnotationNonAlignedPrefix reproduces a prior bug where querying a
+// prefixBits that wasn't a multiple of nBits(8) only returned the count of
+// the single top-byte bucket containing prefixCell, instead of merging
+// across every bucket that shares the requested top bits.
+func TestAnnotationNonAlignedPrefix(t *testing.T) {
+	tr := NewTreeG[string](nil)
+	tr.RegisterAnnotator("count", countAnnotator{})
+	// 16 buckets across the top byte, 20 items each.
+	for bucket := uint64(0); bucket < 16; bucket++ {
+		for i := uint64(0); i < 20; i++ {
+			tr.Insert(bucket<<56|i, "a")
+		}
+	}
+	// a couple of extra items scattered within the same 16 buckets.
+	tr.Insert(0x01<<56|1000, "a")
+	tr.Insert(0x0F<<56|1000, "a")
+
+	// prefixBits=4 covers the top nibble, i.e. buckets 0x00-0x0F: all of them.
+	got := tr.Annotation("count", 0, 4)
+	if got.(int) != 320+2 {
+		t.Fatalf("expected 322, got %v", got)
+	}
+
+	// a single bucket, addressed with a full byte prefix, should only see
+	// its own items.
+	got = tr.Annotation("count", 0x01<<56, 8)
+	if got.(int) != 21 {
+		t.Fatalf("expected 21, got %v", got)
+	}
+}
+
+// TestAnnotationInvalidation checks that cached annotation values are
+// recomputed after the tree is mutated.
+func TestAnnotationInvalidation(t *testing.T) {
+	tr := NewTreeG[string](nil)
+	tr.RegisterAnnotator("count", countAnnotator{})
+	for i := uint64(0); i < 50; i++ {
+		tr.Insert(i, "a")
+	}
+	if got := tr.Annotation("count", 0, 0); got.(int) != 50 {
+		t.Fatalf("expected 50, got %v", got)
+	}
+	tr.Insert(1000, "a")
+	if got := tr.Annotation("count", 0, 0); got.(int) != 51 {
+		t.Fatalf("expected 51 after insert, got %v", got)
+	}
+	tr.Remove(1000, func(data string) bool { return true })
+	if got := tr.Annotation("count", 0, 0); got.(int) != 50 {
+		t.Fatalf("expected 50 after remove, got %v", got)
+	}
+}
+
+// TestRangeBounded checks that RangeBounded visits exactly the half-open
+// interval [lo, hi) in increasing cell order.
+func TestRangeBounded(t *testing.T) {
+	tr := NewTreeG[int](nil)
+	for i := uint64(0); i < 100; i++ {
+		tr.Insert(i, int(i))
+	}
+	var got []uint64
+	tr.RangeBounded(10, 20, func(cell uint64, data int) bool {
+		got = append(got, cell)
+		return true
+	})
+	if len(got) != 10 {
+		t.Fatalf("expected 10 items, got %d", len(got))
+	}
+	for i, cell := range got {
+		if cell != uint64(10+i) {
+			t.Fatalf("expected cell %d at index %d, got %d", 10+i, i, cell)
+		}
+	}
+
+	// an empty range should visit nothing.
+	got = got[:0]
+	tr.RangeBounded(200, 210, func(cell uint64, data int) bool {
+		got = append(got, cell)
+		return true
+	})
+	if len(got) != 0 {
+		t.Fatalf("expected empty range to visit nothing, got %v", got)
+	}
+}
+
+// TestDescend checks that Descend visits cells <= the start cell in
+// decreasing order.
+func TestDescend(t *testing.T) {
+	tr := NewTreeG[int](nil)
+	for i := uint64(0); i < 100; i++ {
+		tr.Insert(i, int(i))
+	}
+	var got []uint64
+	tr.Descend(49, func(cell uint64, data int) bool {
+		got = append(got, cell)
+		return true
+	})
+	if len(got) != 50 {
+		t.Fatalf("expected 50 items, got %d", len(got))
+	}
+	for i, cell := range got {
+		if cell != uint64(49-i) {
+			t.Fatalf("expected cell %d at index %d, got %d", 49-i, i, cell)
+		}
+	}
+}
+
+// TestDescendRange checks that DescendRange visits exactly the closed
+// interval [lo, hi] in decreasing cell order, starting at hi.
+func TestDescendRange(t *testing.T) {
+	tr := NewTreeG[int](nil)
+	for i := uint64(0); i < 100; i++ {
+		tr.Insert(i, int(i))
+	}
+	var got []uint64
+	tr.DescendRange(29, 20, func(cell uint64, data int) bool {
+		got = append(got, cell)
+		return true
+	})
+	if len(got) != 10 {
+		t.Fatalf("expected 10 items, got %d", len(got))
+	}
+	for i, cell := range got {
+		if cell != uint64(29-i) {
+			t.Fatalf("expected cell %d at index %d, got %d", 29-i, i, cell)
+		}
+	}
+
+	// an empty range should visit nothing.
+	got = got[:0]
+	tr.DescendRange(5, 10, func(cell uint64, data int) bool {
+		got = append(got, cell)
+		return true
+	})
+	if len(got) != 0 {
+		t.Fatalf("expected empty range to visit nothing, got %v", got)
+	}
+}
+
+// TestDescendRangeFullSweep checks a full-tree reverse sweep visits every
+// item in decreasing order.
+func TestDescendRangeFullSweep(t *testing.T) {
+	tr := NewTreeG[int](nil)
+	for i := uint64(0); i < 300; i++ {
+		tr.Insert(i, int(i))
+	}
+	var got []uint64
+	tr.DescendRange(299, 0, func(cell uint64, data int) bool {
+		got = append(got, cell)
+		return true
+	})
+	if len(got) != 300 {
+		t.Fatalf("expected 300 items, got %d", len(got))
+	}
+	for i, cell := range got {
+		if cell != uint64(299-i) {
+			t.Fatalf("expected cell %d at index %d, got %d", 299-i, i, cell)
+		}
+	}
+}
+
+// TestInsertHintClusteredInsert checks that InsertHint keeps every cell, in
+// sorted order, when feeding it a batch of clustered, increasing cells
+// sharing many high-order bits.
+func TestInsertHintClusteredInsert(t *testing.T) {
+	tr := NewTreeG[int](nil)
+	var hint PathHint
+	base := uint64(0x1234_0000)
+	for i := uint64(0); i < 2000; i++ {
+		tr.InsertHint(base+i, int(i), &hint)
+	}
+	if tr.Count() != 2000 {
+		t.Fatalf("expected count 2000, got %d", tr.Count())
+	}
+	var got []uint64
+	tr.Scan(func(cell uint64, data int) bool {
+		got = append(got, cell)
+		return true
+	})
+	if len(got) != 2000 {
+		t.Fatalf("expected to scan 2000 items, got %d", len(got))
+	}
+	for i, cell := range got {
+		if cell != base+uint64(i) {
+			t.Fatalf("expected cell %d at index %d, got %d", base+uint64(i), i, cell)
+		}
+	}
+}
+
+// TestInsertHintOutOfOrder checks that InsertHint still inserts correctly
+// (keeping cells sorted) when a cell doesn't match the hinted leaf
+// position, since real clustered workloads aren't perfectly monotonic.
+func TestInsertHintOutOfOrder(t *testing.T) {
+	tr := NewTreeG[int](nil)
+	var hint PathHint
+	cells := []uint64{10, 20, 15, 5, 25, 12}
+	for _, c := range cells {
+		tr.InsertHint(c, int(c), &hint)
+	}
+	var got []uint64
+	tr.Scan(func(cell uint64, data int) bool {
+		got = append(got, cell)
+		return true
+	})
+	want := []uint64{5, 10, 12, 15, 20, 25}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d items, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected cell %d at index %d, got %d", want[i], i, got[i])
+		}
+	}
+}
+
+// TestRemoveHintClusteredRemove checks that RemoveHint removes the right
+// items from a batch of clustered cells, leaving the rest intact.
+func TestRemoveHintClusteredRemove(t *testing.T) {
+	tr := NewTreeG[int](nil)
+	var hint PathHint
+	base := uint64(0x5678_0000)
+	for i := uint64(0); i < 1000; i++ {
+		tr.InsertHint(base+i, int(i), &hint)
+	}
+	for i := uint64(0); i < 1000; i += 2 {
+		tr.RemoveHint(base+i, func(data int) bool { return true }, &hint)
+	}
+	if tr.Count() != 500 {
+		t.Fatalf("expected count 500, got %d", tr.Count())
+	}
+	tr.Scan(func(cell uint64, data int) bool {
+		if (cell-base)%2 == 0 {
+			t.Fatalf("expected cell %d to have been removed", cell)
+		}
+		return true
+	})
+}
+
+// TestRangeHintClusteredRange checks that RangeHint visits the same cells,
+// in the same order, as Range over a batch of clustered cells.
+func TestRangeHintClusteredRange(t *testing.T) {
+	tr := NewTreeG[int](nil)
+	var hint PathHint
+	base := uint64(0x9abc_0000)
+	for i := uint64(0); i < 500; i++ {
+		tr.InsertHint(base+i, int(i), &hint)
+	}
+	var gotHint, gotPlain []uint64
+	tr.RangeHint(base+100, func(cell uint64, data int) bool {
+		gotHint = append(gotHint, cell)
+		return true
+	}, &hint)
+	tr.Range(base+100, func(cell uint64, data int) bool {
+		gotPlain = append(gotPlain, cell)
+		return true
+	})
+	if len(gotHint) != len(gotPlain) {
+		t.Fatalf("expected %d items from RangeHint, got %d", len(gotPlain), len(gotHint))
+	}
+	for i := range gotPlain {
+		if gotHint[i] != gotPlain[i] {
+			t.Fatalf("expected cell %d at index %d, got %d", gotPlain[i], i, gotHint[i])
+		}
+	}
+}
+
+// TestNewFreeListDefaultSize checks that a non-positive size falls back to
+// defaultFreeListSize.
+func TestNewFreeListDefaultSize(t *testing.T) {
+	fl := NewFreeList[int](0)
+	if cap(fl.nodes) != defaultFreeListSize {
+		t.Fatalf("expected default capacity %d, got %d", defaultFreeListSize, cap(fl.nodes))
+	}
+}
+
+// TestNewWithFreeList checks that a Tree built with NewWithFreeList draws
+// its nodes from the given FreeList and behaves like any other Tree.
+func TestNewWithFreeList(t *testing.T) {
+	fl := NewFreeList[interface{}](8)
+	tr := NewWithFreeList(fl)
+	for i := uint64(0); i < 100; i++ {
+		tr.Insert(i, i)
+	}
+	if tr.Count() != 100 {
+		t.Fatalf("expected count 100, got %d", tr.Count())
+	}
+	if tr.base.freelist != fl {
+		t.Fatalf("expected tree to draw from the given freelist")
+	}
+}
+
+// TestFreeListCOWIsolation guards the invariant that a node freed back to a
+// shared FreeList is never still reachable from another tree that shares
+// that list: freeing must only ever happen to a tree's own private (COW'd)
+// copy of a node, never to one still referenced through a Clone().
+func TestFreeListCOWIsolation(t *testing.T) {
+	fl := NewFreeList[int](4)
+	tr := NewTreeG[int](fl)
+	const bucketA = uint64(0x01) << 56
+	const bucketB = uint64(0x02) << 56
+	for i := uint64(0); i < 200; i++ {
+		tr.Insert(bucketA+i, int(i))
+		tr.Insert(bucketB+i, int(i))
+	}
+	if tr.Count() != 400 {
+		t.Fatalf("expected count 400, got %d", tr.Count())
+	}
+
+	c := tr.Clone()
+
+	// empty out bucket A on tr only; this collapses and frees tr's own
+	// COW'd copy of that leaf, never touching the node c still shares.
+	for i := uint64(0); i < 200; i++ {
+		tr.Remove(bucketA+i, func(data int) bool { return true })
+	}
+	if tr.Count() != 200 {
+		t.Fatalf("expected tr count 200 after removing bucket A, got %d", tr.Count())
+	}
+	if c.Count() != 400 {
+		t.Fatalf("expected clone count to stay 400, got %d", c.Count())
+	}
+
+	// force c to allocate new nodes, which may draw the node tr just
+	// freed back out of the shared pool.
+	const bucketC = uint64(0x03) << 56
+	for i := uint64(0); i < 200; i++ {
+		c.Insert(bucketC+i, int(i))
+	}
+	if c.Count() != 600 {
+		t.Fatalf("expected clone count 600 after insert, got %d", c.Count())
+	}
+
+	// c must still see all of its original items, untouched by tr's
+	// removal or by any node recycling through the shared freelist.
+	seen := make(map[uint64]bool)
+	c.Scan(func(cell uint64, data int) bool {
+		seen[cell] = true
+		return true
+	})
+	for i := uint64(0); i < 200; i++ {
+		if !seen[bucketA+i] {
+			t.Fatalf("expected clone to still contain cell %d", bucketA+i)
+		}
+		if !seen[bucketB+i] {
+			t.Fatalf("expected clone to still contain cell %d", bucketB+i)
+		}
+		if !seen[bucketC+i] {
+			t.Fatalf("expected clone to contain newly inserted cell %d", bucketC+i)
+		}
+	}
+
+	// tr must no longer see any bucket A items.
+	tr.Scan(func(cell uint64, data int) bool {
+		if cell>>56 == 0x01 {
+			t.Fatalf("expected tr to no longer contain bucket A cell %d", cell)
+		}
+		return true
+	})
+}